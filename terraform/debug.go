@@ -1,15 +1,13 @@
 package terraform
 
 import (
-	"archive/zip"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"strings"
 	"sync"
-	"time"
 )
 
 // DebugInfo is the global handler for writing the debug archive. All methods
@@ -17,8 +15,12 @@ import (
 // the debug archive. All methods are safe to call in the nil value.
 var DebugInfo *debugInfo
 
-// SetDebugInfo sets the debug options for the terraform package. Currently
-// this just sets the path where the archive will be written.
+// SetDebugInfo sets the debug options for the terraform package. path is
+// either a bare directory (legacy behavior: a local archive, zip unless
+// TF_DEBUG_FORMAT says otherwise, is created there), or a scheme-qualified
+// destination understood by newDebugSink, such
+// as dir:///tmp/debug/, sftp://user@host/path, s3://bucket/prefix, or "-" to
+// stream the archive to stdout.
 func SetDebugInfo(path string) error {
 	if os.Getenv("TF_DEBUG") == "" {
 		return nil
@@ -33,36 +35,48 @@ func SetDebugInfo(path string) error {
 	return nil
 }
 
-func newDebugInfo(dir string) (*debugInfo, error) {
-	err := os.MkdirAll(dir, 0755)
+func newDebugInfo(dest string) (*debugInfo, error) {
+	sink, err := newDebugSink(dest)
 	if err != nil {
 		return nil, err
 	}
 
-	// FIXME: not guaranteed unique, but good enough for now
-	name := fmt.Sprintf("debug-%s", time.Now().Format("2006-01-02-15-04-05.999999999"))
-	archivePath := filepath.Join(dir, name)
-
-	f, err := os.OpenFile(archivePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	sink, err = newAsyncSink(sink)
 	if err != nil {
 		return nil, err
 	}
 
 	d := &debugInfo{
-		Name:    name,
-		file:    f,
-		archive: zip.NewWriter(f),
+		Name: dest,
+		sink: sink,
+	}
+
+	if os.Getenv("TF_DEBUG_DEDUP") != "" {
+		d.dedup = newDedupStore()
 	}
+
 	return d, nil
 }
 
 type debugInfo struct {
 	Name string
 	sync.Mutex
-	file    *os.File
-	archive *zip.Writer
-	step    int
-	closed  bool
+	sink   DebugSink
+	step   int
+	closed bool
+
+	// dedup, if non-nil, routes blobs written via WriteFile/WriteGraph
+	// through content-addressable storage instead of writing them
+	// straight to sink.
+	dedup *dedupStore
+
+	// events accumulates the structured debug/events.ndjson stream; see
+	// emitEvent and Group.
+	events bytes.Buffer
+
+	// groups tracks the Pre*/Post* hook pairs currently bracketed by a
+	// Group, keyed by kind+resource; see beginGroup/endGroup.
+	groups groups
 
 	hookLogs bytes.Buffer
 }
@@ -80,10 +94,19 @@ func (d *debugInfo) Close() error {
 	}
 	d.closed = true
 
-	if err := d.archive.Close(); err != nil {
-		return err
+	if d.dedup != nil {
+		if err := d.dedup.close(d.sink); err != nil {
+			return err
+		}
+	}
+
+	if d.events.Len() > 0 {
+		if err := d.sink.WriteEntry("debug/events.ndjson", bytes.NewReader(d.events.Bytes())); err != nil {
+			return err
+		}
 	}
-	return d.file.Close()
+
+	return d.sink.Close()
 }
 
 // Write the current graph state to the debug log in dot format.
@@ -92,54 +115,52 @@ func (d *debugInfo) WriteGraph(step string, g *Graph) error {
 		return nil
 	}
 
+	// Group is its own critical section (see emitEvent), so open and
+	// close it outside of d's lock below to avoid self-deadlock.
+	closeGroup := d.Group("walk:" + step)
+	defer closeGroup()
+
 	d.Lock()
 	defer d.Unlock()
 
-	// If we crash, the central directory won't be written, but we can rebuild
-	// the archive if we have to if every file has been flushed and sync'ed.
-	defer func() {
-		d.archive.Flush()
-		d.file.Sync()
-	}()
-
 	graphStr, err := GraphDot(g, &GraphDotOpts{
 		DrawCycles: true,
 		MaxDepth:   -1,
 		Verbose:    true,
 	})
+	if err != nil {
+		return err
+	}
 
 	dotPath := fmt.Sprintf("debug/%d-%s.dot", d.step, step)
+	thisStep := d.step
 	d.step++
 
-	fw, err := d.archive.Create(dotPath)
-	if err != nil {
+	if d.dedup != nil {
+		_, err := d.dedup.put(d.sink, thisStep, dotPath, strings.NewReader(graphStr))
 		return err
 	}
-
-	_, err = io.WriteString(fw, graphStr)
-	return err
+	return d.sink.WriteEntry(dotPath, strings.NewReader(graphStr))
 }
 
-// WriteFile writes data as a single file to the debug arhive.
-func (d *debugInfo) WriteFile(name string, data []byte) error {
+// WriteFile writes data as a single file to the debug arhive, returning the
+// content-addressable ref it was stored under if TF_DEBUG_DEDUP is enabled.
+func (d *debugInfo) WriteFile(name string, data []byte) (string, error) {
 	if d == nil {
-		return nil
+		return "", nil
 	}
 
 	d.Lock()
 	defer d.Unlock()
 
 	path := fmt.Sprintf("debug/%d-%s", d.step, name)
+	thisStep := d.step
 	d.step++
 
-	fw, err := d.archive.Create(path)
-	if err != nil {
-		return err
+	if d.dedup != nil {
+		return d.dedup.put(d.sink, thisStep, path, bytes.NewReader(data))
 	}
-
-	_, err = fw.Write(data)
-	return err
-
+	return "", d.sink.WriteEntry(path, bytes.NewReader(data))
 }
 
 // Return a a buffer we can write to, which will be added as a whole to the
@@ -184,7 +205,8 @@ func (s *DebugWriter) Close() error {
 	if s == nil {
 		return nil
 	}
-	return s.debugInfo.WriteFile(s.name, s.buf.Bytes())
+	_, err := s.debugInfo.WriteFile(s.name, s.buf.Bytes())
+	return err
 }
 
 func (s *DebugWriter) Printf(f string, args ...interface{}) (int, error) {
@@ -194,6 +216,15 @@ func (s *DebugWriter) Printf(f string, args ...interface{}) (int, error) {
 	return fmt.Fprintf(&s.buf, f, args...)
 }
 
+// humanID returns ii.HumanId(), or "" for a nil InstanceInfo, so event
+// emission doesn't need its own nil check at every call site.
+func humanID(ii *InstanceInfo) string {
+	if ii == nil {
+		return ""
+	}
+	return ii.HumanId()
+}
+
 type DebugHook struct{}
 
 func (*DebugHook) PreApply(ii *InstanceInfo, is *InstanceState, id *InstanceDiff) (HookAction, error) {
@@ -215,7 +246,9 @@ func (*DebugHook) PreApply(ii *InstanceInfo, is *InstanceState, id *InstanceDiff
 	}
 	buf.Write(js)
 
-	DebugInfo.WriteFile("hook-PreApply", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PreApply", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "apply", Phase: "pre", Resource: humanID(ii), Ref: ref})
+	DebugInfo.beginGroup("apply/"+humanID(ii), "apply: "+humanID(ii))
 
 	return HookActionContinue, nil
 }
@@ -237,7 +270,9 @@ func (*DebugHook) PostApply(ii *InstanceInfo, is *InstanceState, err error) (Hoo
 		buf.WriteString(err.Error())
 	}
 
-	DebugInfo.WriteFile("hook-PostApply", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PostApply", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "apply", Phase: "post", Resource: humanID(ii), Ref: ref})
+	DebugInfo.endGroup("apply/" + humanID(ii))
 
 	return HookActionContinue, nil
 }
@@ -253,7 +288,9 @@ func (*DebugHook) PreDiff(ii *InstanceInfo, is *InstanceState) (HookAction, erro
 		buf.WriteString(is.String())
 		buf.WriteString("\n")
 	}
-	DebugInfo.WriteFile("hook-PreDiff", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PreDiff", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "diff", Phase: "pre", Resource: humanID(ii), Ref: ref})
+	DebugInfo.beginGroup("diff/"+humanID(ii), "diff: "+humanID(ii))
 
 	return HookActionContinue, nil
 }
@@ -271,7 +308,9 @@ func (*DebugHook) PostDiff(ii *InstanceInfo, id *InstanceDiff) (HookAction, erro
 	}
 	buf.Write(js)
 
-	DebugInfo.WriteFile("hook-PostDiff", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PostDiff", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "diff", Phase: "post", Resource: humanID(ii), Ref: ref})
+	DebugInfo.endGroup("diff/" + humanID(ii))
 
 	return HookActionContinue, nil
 }
@@ -287,7 +326,9 @@ func (*DebugHook) PreProvisionResource(ii *InstanceInfo, is *InstanceState) (Hoo
 		buf.WriteString(is.String())
 		buf.WriteString("\n")
 	}
-	DebugInfo.WriteFile("hook-PreProvisionResource", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PreProvisionResource", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "provision_resource", Phase: "pre", Resource: humanID(ii), Ref: ref})
+	DebugInfo.beginGroup("provision_resource/"+humanID(ii), "provision: "+humanID(ii))
 
 	return HookActionContinue, nil
 }
@@ -303,7 +344,9 @@ func (*DebugHook) PostProvisionResource(ii *InstanceInfo, is *InstanceState) (Ho
 		buf.WriteString(is.String())
 		buf.WriteString("\n")
 	}
-	DebugInfo.WriteFile("hook-PostProvisionResource", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PostProvisionResource", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "provision_resource", Phase: "post", Resource: humanID(ii), Ref: ref})
+	DebugInfo.endGroup("provision_resource/" + humanID(ii))
 	return HookActionContinue, nil
 }
 
@@ -315,7 +358,9 @@ func (*DebugHook) PreProvision(ii *InstanceInfo, s string) (HookAction, error) {
 	}
 	buf.WriteString(s + "\n")
 
-	DebugInfo.WriteFile("hook-PreProvision", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PreProvision", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "provision", Phase: "pre", Resource: humanID(ii), Ref: ref})
+	DebugInfo.beginGroup("provision/"+humanID(ii)+"/"+s, "provisioner: "+s)
 	return HookActionContinue, nil
 }
 
@@ -327,7 +372,9 @@ func (*DebugHook) PostProvision(ii *InstanceInfo, s string) (HookAction, error)
 	}
 	buf.WriteString(s + "\n")
 
-	DebugInfo.WriteFile("hook-PostProvision", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PostProvision", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "provision", Phase: "post", Resource: humanID(ii), Ref: ref})
+	DebugInfo.endGroup("provision/" + humanID(ii) + "/" + s)
 	return HookActionContinue, nil
 }
 
@@ -340,7 +387,8 @@ func (*DebugHook) ProvisionOutput(ii *InstanceInfo, s1 string, s2 string) {
 	buf.WriteString(s1 + "\n")
 	buf.WriteString(s2 + "\n")
 
-	DebugInfo.WriteFile("hook-ProvisionOutput", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-ProvisionOutput", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "provision_output", Resource: humanID(ii), Ref: ref})
 }
 
 func (*DebugHook) PreRefresh(ii *InstanceInfo, is *InstanceState) (HookAction, error) {
@@ -354,7 +402,9 @@ func (*DebugHook) PreRefresh(ii *InstanceInfo, is *InstanceState) (HookAction, e
 		buf.WriteString(is.String())
 		buf.WriteString("\n")
 	}
-	DebugInfo.WriteFile("hook-PreRefresh", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PreRefresh", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "refresh", Phase: "pre", Resource: humanID(ii), Ref: ref})
+	DebugInfo.beginGroup("refresh/"+humanID(ii), "refresh: "+humanID(ii))
 	return HookActionContinue, nil
 }
 
@@ -369,7 +419,9 @@ func (*DebugHook) PostRefresh(ii *InstanceInfo, is *InstanceState) (HookAction,
 		buf.WriteString(is.String())
 		buf.WriteString("\n")
 	}
-	DebugInfo.WriteFile("hook-PostRefresh", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PostRefresh", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "refresh", Phase: "post", Resource: humanID(ii), Ref: ref})
+	DebugInfo.endGroup("refresh/" + humanID(ii))
 	return HookActionContinue, nil
 }
 
@@ -381,7 +433,9 @@ func (*DebugHook) PreImportState(ii *InstanceInfo, s string) (HookAction, error)
 	}
 	buf.WriteString(s + "\n")
 
-	DebugInfo.WriteFile("hook-PreImportState", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PreImportState", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "import_state", Phase: "pre", Resource: humanID(ii), Ref: ref})
+	DebugInfo.beginGroup("import_state/"+humanID(ii), "import: "+humanID(ii))
 	return HookActionContinue, nil
 }
 
@@ -399,7 +453,9 @@ func (*DebugHook) PostImportState(ii *InstanceInfo, iss []*InstanceState) (HookA
 			buf.WriteString("\n")
 		}
 	}
-	DebugInfo.WriteFile("hook-PostImportState", buf.Bytes())
+	ref, _ := DebugInfo.WriteFile("hook-PostImportState", buf.Bytes())
+	DebugInfo.emitEvent(debugEvent{Kind: "import_state", Phase: "post", Resource: humanID(ii), Ref: ref})
+	DebugInfo.endGroup("import_state/" + humanID(ii))
 	return HookActionContinue, nil
 }
 
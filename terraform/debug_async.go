@@ -0,0 +1,277 @@
+package terraform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// asyncSinkQueueSize bounds how many entries can be queued before the
+// configured backpressure policy kicks in.
+const asyncSinkQueueSize = 256
+
+// asyncSinkSpillThreshold is the largest entry asyncSink will hold in
+// memory. Anything bigger is spilled to a temp file as it's read, so a
+// large WriteGraph/WriteFile payload doesn't have to be buffered whole just
+// because it's waiting in the queue. This keeps zipFormat's stream-straight-
+// into-deflate property intact; the tar-based formats still buffer (spilling
+// to disk themselves, see tarFormat) because tar needs a size up front.
+const asyncSinkSpillThreshold = 64 * 1024
+
+type backpressurePolicy int
+
+const (
+	backpressureBlock backpressurePolicy = iota
+	backpressureDropOldest
+	backpressureSample
+)
+
+// asyncSink wraps another DebugSink so that hot paths like DebugHook.PostApply
+// and WriteGraph never block on disk I/O or a remote sink. Entries are
+// queued and written by a single background goroutine; TF_DEBUG_BACKPRESSURE
+// selects the policy:
+//
+//	block        (default) WriteEntry blocks until there's room
+//	drop-oldest  when the queue is full, the oldest queued entry is
+//	             discarded to make room
+//	sample=1/N   only 1 in every N entries is queued at all, whether or not
+//	             the queue is full; the others are discarded, and a queued
+//	             one blocks until there's room
+type asyncSink struct {
+	inner      DebugSink
+	policy     backpressurePolicy
+	sampleN    int
+	policyName string
+
+	queue chan asyncEntry
+	wg    sync.WaitGroup
+
+	mu            sync.Mutex
+	dropped       int
+	sampleCounter int
+	writeErr      error
+}
+
+// asyncEntry is a queued write. Exactly one of data or file is set: small
+// entries are held in memory, entries over asyncSinkSpillThreshold are
+// spilled to file.
+type asyncEntry struct {
+	name string
+	data []byte
+	file *os.File
+}
+
+// reader returns the entry's content as a freshly-positioned io.Reader.
+func (e asyncEntry) reader() io.Reader {
+	if e.file != nil {
+		return e.file
+	}
+	return bytes.NewReader(e.data)
+}
+
+// release closes and removes the entry's spill file, if any. Safe to call
+// on entries that were never spilled.
+func (e asyncEntry) release() {
+	if e.file == nil {
+		return
+	}
+	e.file.Close()
+	os.Remove(e.file.Name())
+}
+
+// newAsyncEntry reads r into an asyncEntry, spilling to a temp file instead
+// of growing an in-memory buffer once the payload exceeds
+// asyncSinkSpillThreshold.
+func newAsyncEntry(name string, r io.Reader) (asyncEntry, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, asyncSinkSpillThreshold+1)
+	if err != nil && err != io.EOF {
+		return asyncEntry{}, err
+	}
+	if n <= asyncSinkSpillThreshold {
+		return asyncEntry{name: name, data: buf.Bytes()}, nil
+	}
+
+	f, err := os.CreateTemp("", "tf-debug-async-")
+	if err != nil {
+		return asyncEntry{}, err
+	}
+	if _, err := io.Copy(f, &buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return asyncEntry{}, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return asyncEntry{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return asyncEntry{}, err
+	}
+
+	return asyncEntry{name: name, file: f}, nil
+}
+
+func newAsyncSink(inner DebugSink) (DebugSink, error) {
+	policy, sampleN, err := parseBackpressurePolicy(os.Getenv("TF_DEBUG_BACKPRESSURE"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &asyncSink{
+		inner:      inner,
+		policy:     policy,
+		sampleN:    sampleN,
+		policyName: resolvedPolicyName(policy, sampleN),
+		queue:      make(chan asyncEntry, asyncSinkQueueSize),
+	}
+
+	s.wg.Add(1)
+	go s.drain()
+
+	return s, nil
+}
+
+func parseBackpressurePolicy(v string) (backpressurePolicy, int, error) {
+	switch {
+	case v == "" || v == "block":
+		return backpressureBlock, 0, nil
+	case v == "drop-oldest":
+		return backpressureDropOldest, 0, nil
+	case strings.HasPrefix(v, "sample="):
+		rate := strings.TrimPrefix(v, "sample=")
+		num, denom, ok := strings.Cut(rate, "/")
+		if !ok || num != "1" {
+			return 0, 0, fmt.Errorf("invalid TF_DEBUG_BACKPRESSURE sample rate %q", v)
+		}
+		n, err := strconv.Atoi(denom)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid TF_DEBUG_BACKPRESSURE sample rate %q", v)
+		}
+		return backpressureSample, n, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported TF_DEBUG_BACKPRESSURE policy %q", v)
+	}
+}
+
+// resolvedPolicyName renders policy (and sampleN for the sample policy) back
+// into a TF_DEBUG_BACKPRESSURE-shaped string, so the backpressure summary
+// reports the policy actually in effect rather than the raw env var, which
+// is empty in the default, unset case.
+func resolvedPolicyName(policy backpressurePolicy, sampleN int) string {
+	switch policy {
+	case backpressureDropOldest:
+		return "drop-oldest"
+	case backpressureSample:
+		return fmt.Sprintf("sample=1/%d", sampleN)
+	default:
+		return "block"
+	}
+}
+
+func (s *asyncSink) WriteEntry(name string, r io.Reader) error {
+	if s.policy == backpressureSample {
+		s.mu.Lock()
+		s.sampleCounter++
+		skip := s.sampleCounter%s.sampleN != 0
+		if skip {
+			s.dropped++
+		}
+		s.mu.Unlock()
+		if skip {
+			// Not queueing this one at all: drain it without ever
+			// buffering it, rather than reading it in just to throw
+			// it away.
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+	}
+
+	entry, err := newAsyncEntry(name, r)
+	if err != nil {
+		return err
+	}
+
+	if s.policy == backpressureDropOldest {
+		select {
+		case s.queue <- entry:
+			return nil
+		default:
+		}
+
+		// Queue is full: make room for the newest entry by discarding
+		// the oldest one, then try again.
+		select {
+		case discarded := <-s.queue:
+			discarded.release()
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+		default:
+		}
+
+		select {
+		case s.queue <- entry:
+		default:
+			entry.release()
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+		}
+		return nil
+	}
+
+	// block (default), and the already-sampled-in case above.
+	s.queue <- entry
+	return nil
+}
+
+func (s *asyncSink) drain() {
+	defer s.wg.Done()
+	for entry := range s.queue {
+		err := s.inner.WriteEntry(entry.name, entry.reader())
+		entry.release()
+		if err != nil {
+			s.mu.Lock()
+			s.writeErr = err
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Close drains the queue, records a summary of how many events were
+// dropped and by which policy, and closes the wrapped sink.
+func (s *asyncSink) Close() error {
+	close(s.queue)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	dropped := s.dropped
+	writeErr := s.writeErr
+	s.mu.Unlock()
+
+	summary, err := json.MarshalIndent(struct {
+		Policy  string `json:"policy"`
+		Dropped int    `json:"dropped"`
+	}{
+		Policy:  s.policyName,
+		Dropped: dropped,
+	}, "", "  ")
+	if err == nil {
+		s.inner.WriteEntry("debug/backpressure-summary.json", bytes.NewReader(summary))
+	}
+
+	closeErr := s.inner.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
@@ -0,0 +1,162 @@
+package terraform
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	cases := []struct {
+		in      string
+		policy  backpressurePolicy
+		sampleN int
+		wantErr bool
+	}{
+		{in: "", policy: backpressureBlock},
+		{in: "block", policy: backpressureBlock},
+		{in: "drop-oldest", policy: backpressureDropOldest},
+		{in: "sample=1/10", policy: backpressureSample, sampleN: 10},
+		{in: "sample=1/1", policy: backpressureSample, sampleN: 1},
+		{in: "sample=1/0", wantErr: true},
+		{in: "sample=1/-5", wantErr: true},
+		{in: "sample=1/10garbage", wantErr: true},
+		{in: "sample=nope", wantErr: true},
+		{in: "bogus", wantErr: true},
+	}
+
+	for _, c := range cases {
+		policy, sampleN, err := parseBackpressurePolicy(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseBackpressurePolicy(%q): expected error, got policy=%v sampleN=%d", c.in, policy, sampleN)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBackpressurePolicy(%q): unexpected error: %s", c.in, err)
+			continue
+		}
+		if policy != c.policy {
+			t.Errorf("parseBackpressurePolicy(%q): policy = %v, want %v", c.in, policy, c.policy)
+		}
+		if c.policy == backpressureSample && sampleN != c.sampleN {
+			t.Errorf("parseBackpressurePolicy(%q): sampleN = %d, want %d", c.in, sampleN, c.sampleN)
+		}
+	}
+}
+
+func TestAsyncSinkBlockWritesEveryEntry(t *testing.T) {
+	inner := newMemSink()
+	s := &asyncSink{inner: inner, policy: backpressureBlock, queue: make(chan asyncEntry, asyncSinkQueueSize)}
+	s.wg.Add(1)
+	go s.drain()
+
+	for i := 0; i < 5; i++ {
+		name := "debug/entry-" + string(rune('a'+i))
+		if err := s.WriteEntry(name, strings.NewReader("payload")); err != nil {
+			t.Fatalf("WriteEntry: %s", err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// 5 entries plus the backpressure summary.
+	if got, want := inner.count(), 6; got != want {
+		t.Fatalf("inner sink has %d entries, want %d", got, want)
+	}
+}
+
+func TestAsyncSinkDropOldestBoundsQueueDepth(t *testing.T) {
+	inner := newMemSink()
+	s := &asyncSink{inner: inner, policy: backpressureDropOldest, queue: make(chan asyncEntry, 2)}
+
+	// No drain goroutine running yet: the queue (capacity 2) fills up, so
+	// the double-select dance in WriteEntry has to discard the oldest
+	// entry to make room for the newest rather than blocking.
+	for i := 0; i < 5; i++ {
+		if err := s.WriteEntry("debug/entry", strings.NewReader("payload")); err != nil {
+			t.Fatalf("WriteEntry: %s", err)
+		}
+	}
+
+	if got := len(s.queue); got != 2 {
+		t.Fatalf("queue has %d entries, want 2 (capacity)", got)
+	}
+
+	s.mu.Lock()
+	dropped := s.dropped
+	s.mu.Unlock()
+	if dropped == 0 {
+		t.Fatal("expected some entries to be reported as dropped")
+	}
+
+	s.wg.Add(1)
+	go s.drain()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
+
+func TestAsyncSinkSampleOnlyQueuesEveryNth(t *testing.T) {
+	inner := newMemSink()
+	s := &asyncSink{inner: inner, policy: backpressureSample, sampleN: 3, queue: make(chan asyncEntry, asyncSinkQueueSize)}
+	s.wg.Add(1)
+	go s.drain()
+
+	for i := 0; i < 9; i++ {
+		if err := s.WriteEntry("debug/entry", strings.NewReader("payload")); err != nil {
+			t.Fatalf("WriteEntry: %s", err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// Every 3rd of 9 calls is queued (3 entries), all under the same
+	// name, so the inner sink ends up with that entry plus the summary.
+	if got, want := inner.count(), 2; got != want {
+		t.Fatalf("inner sink has %d entries, want %d", got, want)
+	}
+
+	s.mu.Lock()
+	dropped := s.dropped
+	s.mu.Unlock()
+	if dropped != 6 {
+		t.Fatalf("dropped = %d, want 6", dropped)
+	}
+}
+
+func TestAsyncEntrySpillsLargePayloadsToDisk(t *testing.T) {
+	small := bytes.Repeat([]byte("a"), asyncSinkSpillThreshold)
+	entry, err := newAsyncEntry("small", bytes.NewReader(small))
+	if err != nil {
+		t.Fatalf("newAsyncEntry: %s", err)
+	}
+	defer entry.release()
+	if entry.file != nil {
+		t.Error("expected a payload at the threshold to stay in memory")
+	}
+
+	large := bytes.Repeat([]byte("b"), asyncSinkSpillThreshold+1)
+	entry, err = newAsyncEntry("large", bytes.NewReader(large))
+	if err != nil {
+		t.Fatalf("newAsyncEntry: %s", err)
+	}
+	defer entry.release()
+	if entry.file == nil {
+		t.Fatal("expected a payload over the threshold to spill to a temp file")
+	}
+
+	got, err := io.ReadAll(entry.reader())
+	if err != nil {
+		t.Fatalf("reading spilled entry: %s", err)
+	}
+	if !bytes.Equal(got, large) {
+		t.Error("spilled entry content does not match what was written")
+	}
+}
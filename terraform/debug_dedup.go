@@ -0,0 +1,88 @@
+package terraform
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// dedupStore implements content-addressable storage for debug archive
+// blobs, enabled by setting TF_DEBUG_DEDUP: a payload is written to
+// debug/objects/<hash> the first time its hash is seen, and every write,
+// the first included, gets a small JSON pointer at its usual path in place
+// of the payload, so identical payloads are stored only once.
+type dedupStore struct {
+	seen     map[string]bool
+	manifest []dedupManifestEntry
+}
+
+// dedupManifestEntry is one entry of debug/manifest.json, mapping a step
+// ordinal back to the object that holds its payload.
+type dedupManifestEntry struct {
+	Step   int    `json:"step"`
+	Name   string `json:"name"`
+	Ref    string `json:"ref"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// dedupPointer is what actually gets written at an entry's normal path once
+// dedup is enabled, in place of the raw payload.
+type dedupPointer struct {
+	Ref  string `json:"ref"`
+	Name string `json:"name"`
+}
+
+func newDedupStore() *dedupStore {
+	return &dedupStore{seen: make(map[string]bool)}
+}
+
+// put hashes r (streamed through io.MultiWriter so the hash and a buffered
+// copy are computed in one pass), writes the payload to sink under
+// debug/objects/<hex> the first time that hash is seen, and always writes a
+// small JSON pointer at path so the archive stays readable without special
+// knowledge of the dedup scheme. It returns the content hash as a ref.
+func (s *dedupStore) put(sink DebugSink, step int, path string, r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h, &buf), r); err != nil {
+		return "", err
+	}
+	ref := hex.EncodeToString(h.Sum(nil))
+	data := buf.Bytes()
+
+	if !s.seen[ref] {
+		if err := sink.WriteEntry("debug/objects/"+ref, bytes.NewReader(data)); err != nil {
+			return "", err
+		}
+		s.seen[ref] = true
+	}
+
+	pointer, err := json.Marshal(dedupPointer{Ref: ref, Name: path})
+	if err != nil {
+		return "", err
+	}
+	if err := sink.WriteEntry(path, bytes.NewReader(pointer)); err != nil {
+		return "", err
+	}
+
+	s.manifest = append(s.manifest, dedupManifestEntry{
+		Step:   step,
+		Name:   path,
+		Ref:    ref,
+		Size:   len(data),
+		SHA256: ref,
+	})
+	return ref, nil
+}
+
+// close writes the accumulated manifest to debug/manifest.json.
+func (s *dedupStore) close(sink DebugSink) error {
+	js, err := json.MarshalIndent(s.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return sink.WriteEntry("debug/manifest.json", bytes.NewReader(js))
+}
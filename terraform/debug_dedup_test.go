@@ -0,0 +1,152 @@
+package terraform
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+)
+
+// memSink is a minimal in-memory DebugSink for exercising dedupStore and
+// asyncSink without touching disk.
+type memSink struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	order   []string
+	closed  bool
+}
+
+func newMemSink() *memSink {
+	return &memSink{entries: make(map[string][]byte)}
+}
+
+func (s *memSink) WriteEntry(name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[name]; !ok {
+		s.order = append(s.order, name)
+	}
+	s.entries[name] = data
+	return nil
+}
+
+func (s *memSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *memSink) get(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.entries[name]
+	return data, ok
+}
+
+func (s *memSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func TestDedupStorePutDedupesIdenticalPayloads(t *testing.T) {
+	sink := newMemSink()
+	store := newDedupStore()
+
+	ref1, err := store.put(sink, 1, "debug/pre-apply/1.json", bytes.NewReader([]byte("same state")))
+	if err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	ref2, err := store.put(sink, 2, "debug/post-apply/2.json", bytes.NewReader([]byte("same state")))
+	if err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	if ref1 != ref2 {
+		t.Fatalf("expected identical payloads to share a ref, got %q and %q", ref1, ref2)
+	}
+
+	// The object is stored exactly once under debug/objects/<ref>, even
+	// though put was called twice.
+	if _, ok := sink.get("debug/objects/" + ref1); !ok {
+		t.Fatalf("expected debug/objects/%s to be written", ref1)
+	}
+
+	// Each call still writes its own pointer at its own path.
+	for _, path := range []string{"debug/pre-apply/1.json", "debug/post-apply/2.json"} {
+		raw, ok := sink.get(path)
+		if !ok {
+			t.Fatalf("expected pointer at %s", path)
+		}
+		var p dedupPointer
+		if err := json.Unmarshal(raw, &p); err != nil {
+			t.Fatalf("unmarshal pointer at %s: %s", path, err)
+		}
+		if p.Ref != ref1 {
+			t.Errorf("pointer at %s has ref %q, want %q", path, p.Ref, ref1)
+		}
+	}
+}
+
+func TestDedupStorePutWritesDistinctObjectsForDistinctPayloads(t *testing.T) {
+	sink := newMemSink()
+	store := newDedupStore()
+
+	if _, err := store.put(sink, 1, "debug/a.json", bytes.NewReader([]byte("state a"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if _, err := store.put(sink, 2, "debug/b.json", bytes.NewReader([]byte("state b"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	var objectCount int
+	for _, name := range sink.order {
+		if len(name) > len("debug/objects/") && name[:len("debug/objects/")] == "debug/objects/" {
+			objectCount++
+		}
+	}
+	if objectCount != 2 {
+		t.Fatalf("expected 2 distinct objects, got %d", objectCount)
+	}
+}
+
+func TestDedupStoreCloseWritesManifest(t *testing.T) {
+	sink := newMemSink()
+	store := newDedupStore()
+
+	if _, err := store.put(sink, 1, "debug/a.json", bytes.NewReader([]byte("state a"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if _, err := store.put(sink, 2, "debug/b.json", bytes.NewReader([]byte("state b"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	if err := store.close(sink); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	raw, ok := sink.get("debug/manifest.json")
+	if !ok {
+		t.Fatal("expected debug/manifest.json to be written")
+	}
+
+	var manifest []dedupManifestEntry
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		t.Fatalf("unmarshal manifest: %s", err)
+	}
+	if len(manifest) != 2 {
+		t.Fatalf("expected 2 manifest entries, got %d", len(manifest))
+	}
+	if manifest[0].Step != 1 || manifest[0].Name != "debug/a.json" {
+		t.Errorf("unexpected first manifest entry: %+v", manifest[0])
+	}
+	if manifest[1].Step != 2 || manifest[1].Name != "debug/b.json" {
+		t.Errorf("unexpected second manifest entry: %+v", manifest[1])
+	}
+}
@@ -0,0 +1,102 @@
+package terraform
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// debugEvent is one line of debug/events.ndjson. Alongside the existing
+// per-hook file dumps, debugInfo emits a line for every DebugHook call
+// except PostStateUpdate, and for every Group, so tooling can build a timeline view (plan -> walk ->
+// per-resource -> per-provisioner) without parsing hundreds of loose files.
+type debugEvent struct {
+	Timestamp  time.Time `json:"ts"`
+	Step       int       `json:"step"`
+	Kind       string    `json:"kind"`
+	Resource   string    `json:"resource,omitempty"`
+	Phase      string    `json:"phase,omitempty"`
+	Ref        string    `json:"ref,omitempty"`
+	GroupOpen  string    `json:"group_open,omitempty"`
+	GroupClose string    `json:"group_close,omitempty"`
+}
+
+// emitEvent appends ev to the in-memory event stream, which is flushed to
+// debug/events.ndjson when the archive is closed.
+func (d *debugInfo) emitEvent(ev debugEvent) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ev.Timestamp = time.Now()
+	ev.Step = d.step
+
+	js, err := json.Marshal(ev)
+	if err != nil {
+		// The event stream is best-effort: a marshal failure here
+		// shouldn't take down whatever operation triggered it.
+		return
+	}
+	d.events.Write(js)
+	d.events.WriteByte('\n')
+}
+
+// Group brackets a sequence of writes with group_open/group_close events, so
+// consumers of events.ndjson can render nested spans. The caller must invoke
+// the returned func to close the group.
+func (d *debugInfo) Group(name string) func() {
+	if d == nil {
+		return func() {}
+	}
+
+	d.emitEvent(debugEvent{Kind: "group", GroupOpen: name})
+	return func() {
+		d.emitEvent(debugEvent{Kind: "group", GroupClose: name})
+	}
+}
+
+// groups tracks groups whose open and close happen in two separate calls,
+// such as a DebugHook's Pre*/Post* pair, where there's no single function
+// body to hang a plain defer off of.
+type groups struct {
+	mu   sync.Mutex
+	open map[string]func()
+}
+
+// beginGroup opens a group named name, recording its closer under key so a
+// later, unrelated call can end it with endGroup.
+func (d *debugInfo) beginGroup(key, name string) {
+	if d == nil {
+		return
+	}
+
+	closeFn := d.Group(name)
+
+	d.groups.mu.Lock()
+	defer d.groups.mu.Unlock()
+	if d.groups.open == nil {
+		d.groups.open = make(map[string]func())
+	}
+	d.groups.open[key] = closeFn
+}
+
+// endGroup closes the group previously opened with beginGroup under key. It
+// is a no-op if no such group is open, which keeps it safe to call even when
+// TF_DEBUG is unset.
+func (d *debugInfo) endGroup(key string) {
+	if d == nil {
+		return
+	}
+
+	d.groups.mu.Lock()
+	closeFn := d.groups.open[key]
+	delete(d.groups.open, key)
+	d.groups.mu.Unlock()
+
+	if closeFn != nil {
+		closeFn()
+	}
+}
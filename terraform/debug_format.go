@@ -0,0 +1,229 @@
+package terraform
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// debugArchiveFormat encodes named entries into a single underlying byte
+// stream. It is the compression counterpart to DebugSink: a sink decides
+// where the bytes go, a format decides how they're packed.
+type debugArchiveFormat interface {
+	// Create returns a writer for a new entry named name. Callers must
+	// finish writing to the previous entry (if any) before calling Create
+	// again.
+	Create(name string) (io.Writer, error)
+
+	// Flush ensures the most recently created entry has been written into
+	// the archive encoder. For tar+gz and tar+zstd, compressed output may
+	// still be held by the compressor until Close.
+	Flush() error
+
+	// Close flushes any pending entry and finalizes the archive. It does
+	// not close the underlying stream.
+	Close() error
+}
+
+// newDebugArchiveFormat selects a debugArchiveFormat implementation by name.
+// An empty name defaults to "zip" for backwards compatibility with archives
+// written before TF_DEBUG_FORMAT existed.
+func newDebugArchiveFormat(name string, w io.Writer) (debugArchiveFormat, error) {
+	switch name {
+	case "", "zip":
+		return &zipFormat{zw: zip.NewWriter(w)}, nil
+	case "tar":
+		return newTarFormat(w), nil
+	case "tar+gz":
+		gz := gzip.NewWriter(w)
+		return &tarGzFormat{gz: gz, tarFormat: newTarFormat(gz)}, nil
+	case "tar+zstd":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("tar+zstd debug format: %s", err)
+		}
+		return &tarZstdFormat{zstd: zw, tarFormat: newTarFormat(zw)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported TF_DEBUG_FORMAT %q", name)
+	}
+}
+
+// zipFormat is the original hard-coded format: a standard zip archive. Since
+// zip.Writer.Create doesn't need to know an entry's size up front, it can
+// stream straight into the deflate compressor with no intermediate buffer.
+type zipFormat struct {
+	zw *zip.Writer
+}
+
+func (f *zipFormat) Create(name string) (io.Writer, error) {
+	return f.zw.Create(name)
+}
+
+func (f *zipFormat) Flush() error {
+	return f.zw.Flush()
+}
+
+func (f *zipFormat) Close() error {
+	return f.zw.Close()
+}
+
+// tarFormat writes entries as a tar stream. Unlike zip, tar needs to know an
+// entry's size before its header can be written, so each entry is buffered
+// until the next Create, Flush or Close call writes it; pendingEntry spills to a
+// temp file past pendingEntrySpillThreshold, the same technique asyncEntry
+// uses, so a large WriteGraph/WriteFile payload isn't held whole in memory.
+type tarFormat struct {
+	tw      *tar.Writer
+	pending *pendingEntry
+}
+
+// pendingEntrySpillThreshold is the largest entry pendingEntry will buffer
+// in memory before spilling to a temp file.
+const pendingEntrySpillThreshold = 64 * 1024
+
+type pendingEntry struct {
+	name string
+	buf  bytes.Buffer
+	file *os.File
+}
+
+// Write implements io.Writer, spilling to a temp file the first time buf
+// would grow past pendingEntrySpillThreshold.
+func (p *pendingEntry) Write(b []byte) (int, error) {
+	if p.file != nil {
+		return p.file.Write(b)
+	}
+	if p.buf.Len()+len(b) <= pendingEntrySpillThreshold {
+		return p.buf.Write(b)
+	}
+
+	f, err := os.CreateTemp("", "tf-debug-tar-")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(p.buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	}
+	p.buf.Reset()
+	p.file = f
+	return p.file.Write(b)
+}
+
+// size reports how many bytes have been written so far.
+func (p *pendingEntry) size() (int64, error) {
+	if p.file == nil {
+		return int64(p.buf.Len()), nil
+	}
+	info, err := p.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// reader returns the entry's content from the start, and release cleans up
+// its temp file, if any, once the caller is done reading.
+func (p *pendingEntry) reader() (io.Reader, error) {
+	if p.file == nil {
+		return bytes.NewReader(p.buf.Bytes()), nil
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return p.file, nil
+}
+
+func (p *pendingEntry) release() {
+	if p.file != nil {
+		p.file.Close()
+		os.Remove(p.file.Name())
+	}
+}
+
+func newTarFormat(w io.Writer) *tarFormat {
+	return &tarFormat{tw: tar.NewWriter(w)}
+}
+
+func (f *tarFormat) Create(name string) (io.Writer, error) {
+	if err := f.flushPending(); err != nil {
+		return nil, err
+	}
+	f.pending = &pendingEntry{name: name}
+	return f.pending, nil
+}
+
+func (f *tarFormat) flushPending() error {
+	if f.pending == nil {
+		return nil
+	}
+	p := f.pending
+	f.pending = nil
+	defer p.release()
+
+	size, err := p.size()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    p.name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := f.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	r, err := p.reader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f.tw, r)
+	return err
+}
+
+func (f *tarFormat) Flush() error {
+	return f.flushPending()
+}
+
+func (f *tarFormat) Close() error {
+	if err := f.flushPending(); err != nil {
+		return err
+	}
+	return f.tw.Close()
+}
+
+// tarGzFormat is a tarFormat whose output is piped through gzip.
+type tarGzFormat struct {
+	*tarFormat
+	gz *gzip.Writer
+}
+
+func (f *tarGzFormat) Close() error {
+	if err := f.tarFormat.Close(); err != nil {
+		return err
+	}
+	return f.gz.Close()
+}
+
+// tarZstdFormat is a tarFormat piped through zstd, trading extra CPU time
+// for a smaller archive than tar+gz.
+type tarZstdFormat struct {
+	*tarFormat
+	zstd *zstd.Encoder
+}
+
+func (f *tarZstdFormat) Close() error {
+	if err := f.tarFormat.Close(); err != nil {
+		return err
+	}
+	return f.zstd.Close()
+}
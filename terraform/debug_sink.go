@@ -0,0 +1,319 @@
+package terraform
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DebugSink is the destination side of the debug archive: it knows how to
+// persist named entries somewhere, but nothing about how those entries are
+// encoded. newDebugInfo picks an implementation based on the scheme of the
+// path passed to SetDebugInfo, so a single TF_DEBUG run can write to a local
+// zip file, a directory of loose files, a remote host over SFTP, an S3
+// bucket, or stdout.
+type DebugSink interface {
+	// WriteEntry persists r under name. Implementations must fully consume
+	// r before returning.
+	WriteEntry(name string, r io.Reader) error
+
+	// Close flushes and releases any resources held by the sink.
+	Close() error
+}
+
+// newDebugSink parses dest and returns the DebugSink it describes. dest may
+// be a bare filesystem path (legacy behavior: a directory that gets a new,
+// autogenerated archive file each run), a scheme-qualified URI (file://,
+// dir://, sftp://, s3://), or "-" to stream the archive to stdout. For a
+// bare path, file://, and "-", the archive encoding is chosen by
+// TF_DEBUG_FORMAT (default "zip"); tar+gz:// and "<format>:-" fix it
+// instead. See newDebugArchiveFormat.
+//
+// Recognized schemes:
+//
+//	file:///tmp/debug.zip   a single local archive at exactly that path (default)
+//	tar+gz:///tmp/debug.tgz a single local archive at exactly that path, forced to tar+gz
+//	dir:///tmp/debug/       one loose file per entry under a local directory
+//	sftp://user@host/path   one loose file per entry, uploaded over SFTP
+//	s3://bucket/prefix      one object per entry, uploaded to S3
+//	-                       the archive streamed to stdout, format from TF_DEBUG_FORMAT
+//	tar:-, zip:-, ...       the archive streamed to stdout, format fixed by the prefix
+func newDebugSink(dest string) (DebugSink, error) {
+	format := os.Getenv("TF_DEBUG_FORMAT")
+
+	if dest == "-" {
+		return newArchiveSink(os.Stdout, format, false)
+	}
+
+	// "<format>:-" pins the format in the destination itself, e.g.
+	// TF_DEBUG=tar:- for piping into `tar tvf -`. This has to be checked
+	// before the "://" test below: a typo'd scheme name here would
+	// otherwise silently fall through to the bare-path branch and create
+	// a directory literally named "tar:-".
+	if strings.HasSuffix(dest, ":-") {
+		return newArchiveSink(os.Stdout, strings.TrimSuffix(dest, ":-"), false)
+	}
+
+	// A bare path with no "scheme://" prefix is legacy usage: treat it as
+	// a directory that will hold a single, autogenerated-name local
+	// archive, as opposed to file:// below, which names the archive
+	// itself.
+	if !strings.Contains(dest, "://") {
+		return newFileSink(dest, format, false)
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TF_DEBUG destination %q: %s", dest, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return newFileSink(u.Path, format, true)
+	case "tar+gz":
+		return newFileSink(u.Path, "tar+gz", true)
+	case "dir":
+		return newDirSink(u.Path)
+	case "sftp":
+		return newSFTPSink(u)
+	case "s3":
+		return newS3Sink(u)
+	default:
+		return nil, fmt.Errorf("unsupported TF_DEBUG destination scheme %q", u.Scheme)
+	}
+}
+
+// archiveSink writes every entry into a single encoded archive stream,
+// using a pluggable debugArchiveFormat to do the encoding.
+type archiveSink struct {
+	w               io.WriteCloser
+	format          debugArchiveFormat
+	closeUnderlying bool
+}
+
+// newArchiveSink wraps w in the archive format named by formatName. When
+// closeUnderlying is false, w is flushed but never closed; this is used for
+// os.Stdout, which callers don't expect a library to close out from under
+// them.
+func newArchiveSink(w io.WriteCloser, formatName string, closeUnderlying bool) (DebugSink, error) {
+	format, err := newDebugArchiveFormat(formatName, w)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveSink{w: w, format: format, closeUnderlying: closeUnderlying}, nil
+}
+
+func (s *archiveSink) WriteEntry(name string, r io.Reader) error {
+	w, err := s.format.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return s.format.Flush()
+}
+
+func (s *archiveSink) Close() error {
+	if err := s.format.Close(); err != nil {
+		return err
+	}
+	if s.closeUnderlying {
+		return s.w.Close()
+	}
+	return nil
+}
+
+// newFileSink opens a local archive file and wraps it in the archive format
+// named by formatName. When exact is true, path is the archive file itself
+// (as given by a file:// or tar+gz:// destination), so it's opened directly,
+// truncating any existing file at that path. When exact is false (the
+// legacy bare-path case), path is a directory that gets a new,
+// autogenerated archive file each run.
+func newFileSink(path, formatName string, exact bool) (DebugSink, error) {
+	var archivePath string
+	var flags int
+	if exact {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		archivePath = path
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	} else {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		archivePath = filepath.Join(path, debugArchiveName())
+		flags = os.O_RDWR | os.O_CREATE | os.O_EXCL
+	}
+
+	f, err := os.OpenFile(archivePath, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	sink, err := newArchiveSink(f, formatName, true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// dirSink writes each entry as its own file under a local directory, with
+// no archiving or compression. Handy when a caller wants to poke around the
+// debug output with plain shell tools.
+type dirSink struct {
+	dir string
+}
+
+func newDirSink(dir string) (DebugSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirSink{dir: dir}, nil
+}
+
+func (s *dirSink) WriteEntry(name string, r io.Reader) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (s *dirSink) Close() error {
+	return nil
+}
+
+// sftpSink uploads each entry as its own file under a remote directory over
+// SFTP, authenticating with the local SSH agent.
+type sftpSink struct {
+	client *sftp.Client
+	conn   *ssh.Client
+	dir    string
+}
+
+func newSFTPSink(u *url.URL) (DebugSink, error) {
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{sshAgentAuth()},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	addr := u.Host
+	if !strings.Contains(addr, ":") {
+		addr += ":22"
+	}
+
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("sftp debug sink: %s", err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sftp debug sink: %s", err)
+	}
+
+	dir := u.Path
+	if err := client.MkdirAll(dir); err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	return &sftpSink{client: client, conn: conn, dir: dir}, nil
+}
+
+func (s *sftpSink) WriteEntry(name string, r io.Reader) error {
+	remotePath := path.Join(s.dir, name)
+	if err := s.client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+
+	f, err := s.client.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (s *sftpSink) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
+
+// s3Sink uploads each entry as an object under bucket/prefix in S3, using
+// the default AWS credential chain.
+type s3Sink struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func newS3Sink(u *url.URL) (DebugSink, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 debug sink: %s", err)
+	}
+
+	return &s3Sink{
+		client: s3.New(sess),
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+	}, nil
+}
+
+func (s *s3Sink) WriteEntry(name string, r io.Reader) error {
+	buf, err := readAllSeeker(r)
+	if err != nil {
+		return err
+	}
+
+	key := name
+	if s.prefix != "" {
+		key = s.prefix + "/" + name
+	}
+
+	_, err = s.client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   buf,
+	})
+	return err
+}
+
+func (s *s3Sink) Close() error {
+	return nil
+}
@@ -0,0 +1,49 @@
+package terraform
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// debugArchiveName returns the filename (with no directory component) used
+// for a new debug archive.
+func debugArchiveName() string {
+	// FIXME: not guaranteed unique, but good enough for now
+	return fmt.Sprintf("debug-%s", time.Now().Format("2006-01-02-15-04-05.999999999"))
+}
+
+// readAllSeeker buffers r fully and returns it as an io.ReadSeeker, which
+// several upload APIs (notably S3's PutObject) require in place of a plain
+// io.Reader.
+func readAllSeeker(r io.Reader) (io.ReadSeeker, error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// sshAgentAuth returns an ssh.AuthMethod backed by the local ssh-agent, used
+// to authenticate the sftp debug sink. With no reachable agent it falls back
+// to an AuthMethod with no keys.
+func sshAgentAuth() ssh.AuthMethod {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return ssh.PublicKeys()
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return ssh.PublicKeys()
+	}
+
+	client := agent.NewClient(conn)
+	return ssh.PublicKeysCallback(client.Signers)
+}